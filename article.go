@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	neturl "net/url"
+	"strings"
+
+	readability "github.com/go-shiori/go-readability"
+)
+
+// wordsPerMinute is the reading speed we assume when estimating how long an
+// article takes to read, for the "Reading time: X min" line in the rich
+// tooltip.
+const wordsPerMinute = 200
+
+// excerptMaxLength caps how much of an article's excerpt we show in the
+// tooltip; readability excerpts can run to several paragraphs for pages
+// that don't set an explicit meta description.
+const excerptMaxLength = 200
+
+// article holds the subset of a go-readability Article we care about for
+// building a rich tooltip. It's what gets cached under the "article:" key,
+// separately from the rendered tooltip, so changing the tooltip layout
+// doesn't require re-running readability on pages we've already seen (the
+// page itself is still fetched on a tooltip cache miss).
+type article struct {
+	Title      string `json:"title"`
+	Byline     string `json:"byline"`
+	Excerpt    string `json:"excerpt"`
+	SiteName   string `json:"siteName"`
+	Image      string `json:"image"`
+	ReadingMin int    `json:"readingMin"`
+}
+
+// extractArticle runs readability on an already-fetched HTML body to pull
+// out the fields a rich tooltip needs. pageURL is used to resolve relative
+// links readability finds in the document (e.g. a relative og:image).
+func extractArticle(pageURL string, body []byte) (*article, error) {
+	parsedURL, err := neturl.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := readability.FromReader(bytes.NewReader(body), parsedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	wordCount := len(strings.Fields(parsed.TextContent))
+	readingMin := wordCount / wordsPerMinute
+	if readingMin < 1 {
+		readingMin = 1
+	}
+
+	return &article{
+		Title:      parsed.Title,
+		Byline:     parsed.Byline,
+		Excerpt:    parsed.Excerpt,
+		SiteName:   parsed.SiteName,
+		Image:      parsed.Image,
+		ReadingMin: readingMin,
+	}, nil
+}
+
+// truncateExcerpt shortens s to at most n runes, breaking on a word boundary
+// and adding an ellipsis when it had to cut anything off.
+func truncateExcerpt(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	cut := string(runes[:n])
+	if i := strings.LastIndexByte(cut, ' '); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// buildArticleTooltip renders a readability-extracted article into the rich
+// tooltip format: thumbnail, title, site name, byline, a truncated excerpt
+// and an estimated reading time, falling back gracefully on whichever
+// fields readability wasn't able to find.
+func buildArticleTooltip(pageURL string, art *article) string {
+	var b strings.Builder
+	b.WriteString(`<div style="text-align: left;">`)
+	if art.Image != "" {
+		fmt.Fprintf(&b, `<img src="%s" height="128"><hr>`, html.EscapeString(art.Image))
+	}
+	if art.Title != "" {
+		fmt.Fprintf(&b, "<b>%s</b><br>", html.EscapeString(art.Title))
+	}
+	if art.SiteName != "" {
+		fmt.Fprintf(&b, "<b>Site:</b> %s<br>", html.EscapeString(art.SiteName))
+	}
+	if art.Byline != "" {
+		fmt.Fprintf(&b, "<b>By:</b> %s<br>", html.EscapeString(art.Byline))
+	}
+	if art.ReadingMin > 0 {
+		fmt.Fprintf(&b, "<b>Reading time:</b> %d min<br>", art.ReadingMin)
+	}
+	if art.Excerpt != "" {
+		fmt.Fprintf(&b, "%s<br>", html.EscapeString(truncateExcerpt(art.Excerpt, excerptMaxLength)))
+	}
+	b.WriteString("<hr>")
+	fmt.Fprintf(&b, "<b>URL:</b> %s</div>", html.EscapeString(pageURL))
+
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestExtractArticle_ParsesReadableHTML feeds extractArticle a minimal
+// article-shaped page and checks the fields readability is expected to find,
+// plus the reading-time estimate derived from word count.
+func TestExtractArticle_ParsesReadableHTML(t *testing.T) {
+	words := strings.Repeat("word ", wordsPerMinute*2)
+	body := `<html><head>
+		<title>A Great Article</title>
+		<meta property="og:site_name" content="Example News">
+	</head><body>
+		<article>
+			<h1>A Great Article</h1>
+			<p>By Jane Doe</p>
+			<p>` + words + `</p>
+		</article>
+	</body></html>`
+
+	art, err := extractArticle("https://example.com/article", []byte(body))
+	if err != nil {
+		t.Fatalf("extractArticle() error = %v", err)
+	}
+	if art.Title == "" {
+		t.Error("expected a non-empty title")
+	}
+	if art.ReadingMin != 2 {
+		t.Errorf("got ReadingMin = %d, want 2 for %d words at %d wpm", art.ReadingMin, wordsPerMinute*2, wordsPerMinute)
+	}
+}
+
+// TestExtractArticle_ShortArticleReadingMinFloorsAtOne makes sure a tiny
+// amount of text still reports at least a 1-minute read instead of 0.
+func TestExtractArticle_ShortArticleReadingMinFloorsAtOne(t *testing.T) {
+	body := `<html><head><title>Tiny</title></head><body><article><p>Just a few words here.</p></article></body></html>`
+
+	art, err := extractArticle("https://example.com/tiny", []byte(body))
+	if err != nil {
+		t.Fatalf("extractArticle() error = %v", err)
+	}
+	if art.ReadingMin < 1 {
+		t.Errorf("got ReadingMin = %d, want at least 1", art.ReadingMin)
+	}
+}
+
+// TestExtractArticle_InvalidPageURL covers the error path when pageURL can't
+// be parsed at all.
+func TestExtractArticle_InvalidPageURL(t *testing.T) {
+	if _, err := extractArticle("://not-a-url", []byte("<html></html>")); err == nil {
+		t.Error("expected an error for an unparseable page URL")
+	}
+}
+
+// TestTruncateExcerpt covers the under-limit passthrough, the word-boundary
+// cut, and the case where there's no space to break on at all.
+func TestTruncateExcerpt(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{"under limit unchanged", "short excerpt", 200, "short excerpt"},
+		{"cuts at word boundary", "one two three four", 10, "one two…"},
+		{"no space falls back to hard cut", "abcdefghij", 5, "abcde…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateExcerpt(tt.s, tt.n); got != tt.want {
+				t.Errorf("truncateExcerpt(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBuildArticleTooltip_IncludesPresentFields proves each populated field
+// makes it into the tooltip, reading time included.
+func TestBuildArticleTooltip_IncludesPresentFields(t *testing.T) {
+	art := &article{
+		Title:      "A Great Article",
+		Byline:     "Jane Doe",
+		Excerpt:    "A short summary of the article.",
+		SiteName:   "Example News",
+		Image:      "https://example.com/thumb.png",
+		ReadingMin: 4,
+	}
+
+	got := buildArticleTooltip("https://example.com/article", art)
+
+	for _, want := range []string{"A Great Article", "Jane Doe", "A short summary", "Example News", "4 min", "https://example.com/thumb.png", "https://example.com/article"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("tooltip missing %q: %s", want, got)
+		}
+	}
+}
+
+// TestBuildArticleTooltip_OmitsEmptyFields proves a minimal article doesn't
+// render empty labels for fields readability couldn't find.
+func TestBuildArticleTooltip_OmitsEmptyFields(t *testing.T) {
+	art := &article{Title: "Bare Article"}
+
+	got := buildArticleTooltip("https://example.com/bare", art)
+
+	for _, absent := range []string{"<b>Site:</b>", "<b>By:</b>", "<b>Reading time:</b>", "<img"} {
+		if strings.Contains(got, absent) {
+			t.Errorf("tooltip should not contain %q for a minimal article: %s", absent, got)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// oEmbedResponse covers the subset of the oEmbed spec (https://oembed.com/)
+// that we care about for tooltips. Providers are free to omit any field.
+type oEmbedResponse struct {
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	// Duration isn't part of the oEmbed spec, but several video providers
+	// (e.g. Vimeo) include it anyway, expressed in seconds.
+	Duration float64 `json:"duration"`
+	// ViewCount isn't part of the oEmbed spec either, but it's a common
+	// undocumented extension (YouTube's internal oEmbed mirror included).
+	ViewCount int64 `json:"view_count"`
+}
+
+// fetchOEmbed calls an oEmbed endpoint for pageURL and decodes the response.
+func fetchOEmbed(ctx context.Context, endpoint, pageURL string) (*oEmbedResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("url", pageURL)
+	q.Set("format", "json")
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("User-Agent", PickUserAgent())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("oembed: unexpected status %d from %s", resp.StatusCode, endpoint)
+	}
+
+	var oembed oEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&oembed); err != nil {
+		return nil, err
+	}
+	return &oembed, nil
+}
+
+// openGraphTags holds the handful of Open Graph / Twitter Card meta tags we
+// pull out of a page for tooltip building.
+type openGraphTags struct {
+	Title       string
+	Description string
+	Image       string
+	SiteName    string
+	VideoLength string
+	// CountLabel/Count come from Twitter's twitter:label{1,2}/twitter:data{1,2}
+	// convention, which sites use to surface an arbitrary stat (views, likes,
+	// followers, ...) alongside the card. Count is left as the raw string
+	// when it isn't a plain integer.
+	CountLabel string
+	Count      string
+}
+
+// countLabelPattern matches twitter:label{1,2} values worth surfacing as a
+// tooltip stat - views, likes, followers, subscribers, that sort of thing.
+var countLabelPattern = regexp.MustCompile(`(?i)views?|likes?|followers?|subscribers?`)
+
+func fetchOpenGraph(ctx context.Context, pageURL string) (*openGraphTags, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept-Language", "en-US, en;q=0.9, *;q=0.5")
+	req.Header.Set("User-Agent", PickUserAgent())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := func(property string) string {
+		content, _ := doc.Find(fmt.Sprintf(`meta[property="%s"]`, property)).First().Attr("content")
+		return content
+	}
+
+	og := &openGraphTags{
+		Title:       meta("og:title"),
+		Description: meta("og:description"),
+		Image:       meta("og:image"),
+		SiteName:    meta("og:site_name"),
+		VideoLength: meta("og:video:duration"),
+	}
+	if og.Title == "" {
+		og.Title = doc.Find("title").First().Text()
+	}
+	og.CountLabel, og.Count = findTwitterCountData(doc)
+	return og, nil
+}
+
+// findTwitterCountData looks for a twitter:label{1,2}/twitter:data{1,2} pair
+// whose label reads like a view/like/follower/subscriber count, returning the
+// label and its value. Sites use this pair purely for display, so the value
+// isn't guaranteed to be numeric.
+func findTwitterCountData(doc *goquery.Document) (label, data string) {
+	meta := func(name string) string {
+		content, _ := doc.Find(fmt.Sprintf(`meta[name="%s"]`, name)).First().Attr("content")
+		return content
+	}
+	for _, n := range []string{"1", "2"} {
+		l := meta("twitter:label" + n)
+		if countLabelPattern.MatchString(l) {
+			return l, meta("twitter:data" + n)
+		}
+	}
+	return "", ""
+}
+
+// buildOEmbedTooltip renders an oEmbed result into the same tooltip markup
+// the generic title-scrape path produces, with a thumbnail and author line
+// tacked on when available.
+func buildOEmbedTooltip(pageURL string, oembed *oEmbedResponse) []byte {
+	var b strings.Builder
+	b.WriteString(`<div style="text-align: left;">`)
+	if oembed.ThumbnailURL != "" {
+		fmt.Fprintf(&b, `<img src="%s" height="128"><hr>`, html.EscapeString(oembed.ThumbnailURL))
+	}
+	if oembed.Title != "" {
+		fmt.Fprintf(&b, "<b>%s</b><br>", html.EscapeString(oembed.Title))
+	}
+	if oembed.AuthorName != "" {
+		fmt.Fprintf(&b, "<b>By:</b> %s<br>", html.EscapeString(oembed.AuthorName))
+	}
+	if oembed.Duration > 0 {
+		fmt.Fprintf(&b, "<b>Duration:</b> %s<br>", formatDuration(fmt.Sprintf("PT%.0fS", oembed.Duration)))
+	}
+	if oembed.ViewCount > 0 {
+		fmt.Fprintf(&b, "<b>Views:</b> %s<br>", insertCommas(strconv.FormatInt(oembed.ViewCount, 10), 3))
+	}
+	b.WriteString("<hr>")
+	fmt.Fprintf(&b, "<b>URL:</b> %s</div>", html.EscapeString(pageURL))
+
+	body, _ := json.Marshal(&LinkResolverResponse{
+		Status:  200,
+		Tooltip: b.String(),
+		Link:    pageURL,
+	})
+	return body
+}
+
+func buildOpenGraphTooltip(pageURL string, og *openGraphTags) []byte {
+	var b strings.Builder
+	b.WriteString(`<div style="text-align: left;">`)
+	if og.Image != "" {
+		fmt.Fprintf(&b, `<img src="%s" height="128"><hr>`, html.EscapeString(og.Image))
+	}
+	if og.Title != "" {
+		fmt.Fprintf(&b, "<b>%s</b><br>", html.EscapeString(og.Title))
+	}
+	if og.SiteName != "" {
+		fmt.Fprintf(&b, "<b>Site:</b> %s<br>", html.EscapeString(og.SiteName))
+	}
+	if og.VideoLength != "" {
+		b.WriteString("<b>Duration:</b> " + html.EscapeString(formatDuration("PT"+og.VideoLength+"S")) + "<br>")
+	}
+	if og.Count != "" {
+		count := og.Count
+		if n, err := strconv.ParseInt(count, 10, 64); err == nil {
+			count = insertCommas(strconv.FormatInt(n, 10), 3)
+		}
+		fmt.Fprintf(&b, "<b>%s:</b> %s<br>", html.EscapeString(og.CountLabel), html.EscapeString(count))
+	}
+	if og.Description != "" {
+		fmt.Fprintf(&b, "%s<br>", html.EscapeString(og.Description))
+	}
+	b.WriteString("<hr>")
+	fmt.Fprintf(&b, "<b>URL:</b> %s</div>", html.EscapeString(pageURL))
+
+	body, _ := json.Marshal(&LinkResolverResponse{
+		Status:  200,
+		Tooltip: b.String(),
+		Link:    pageURL,
+	})
+	return body
+}
+
+func init() {
+	RegisterCustomResolver(`(^|\.)youtube\.com$|(^|\.)youtu\.be$`, func(ctx context.Context, u *neturl.URL) ([]byte, time.Duration, error) {
+		oembed, err := fetchOEmbed(ctx, "https://www.youtube.com/oembed", u.String())
+		if err != nil {
+			return nil, 0, err
+		}
+		return buildOEmbedTooltip(u.String(), oembed), time.Hour, nil
+	})
+
+	RegisterCustomResolver(`(^|\.)vimeo\.com$`, func(ctx context.Context, u *neturl.URL) ([]byte, time.Duration, error) {
+		oembed, err := fetchOEmbed(ctx, "https://vimeo.com/api/oembed.json", u.String())
+		if err != nil {
+			return nil, 0, err
+		}
+		return buildOEmbedTooltip(u.String(), oembed), time.Hour, nil
+	})
+
+	// Twitter/imgur/most everything else don't expose a public, keyless
+	// oEmbed endpoint we can rely on, so fall back to scraping their Open
+	// Graph tags instead - still much richer than a bare <title>.
+	RegisterCustomResolver(`(^|\.)twitter\.com$|(^|\.)x\.com$|(^|\.)imgur\.com$`, func(ctx context.Context, u *neturl.URL) ([]byte, time.Duration, error) {
+		og, err := fetchOpenGraph(ctx, u.String())
+		if err != nil {
+			return nil, 0, err
+		}
+		return buildOpenGraphTooltip(u.String(), og), defaultLinkCacheDuration, nil
+	})
+}
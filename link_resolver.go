@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
+	"io"
 	"net/http"
-	"net/url"
+	neturl "net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
 )
 
 type LinkResolverResponse struct {
@@ -22,6 +28,12 @@ type LinkResolverResponse struct {
 	Tooltip string `json:"tooltip,omitempty"`
 	Link    string `json:"link,omitempty"`
 
+	// SiteName and Thumbnail are only populated for the richFormat tooltip
+	// (see extractArticle), where we have a readability-extracted article
+	// to draw them from.
+	SiteName  string `json:"siteName,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+
 	// Flag in the BTTV API to.. maybe signify that the link will download something? idk
 	// Download *bool  `json:"download,omitempty"`
 }
@@ -39,12 +51,12 @@ var invalidURL = &LinkResolverResponse{
 func unescapeURLArgument(r *http.Request, key string) (string, error) {
 	vars := mux.Vars(r)
 	escapedURL := vars[key]
-	url, err := url.PathUnescape(escapedURL)
+	unescapedURL, err := neturl.PathUnescape(escapedURL)
 	if err != nil {
 		return "", err
 	}
 
-	return url, nil
+	return unescapedURL, nil
 }
 
 func formatDuration(dur string) string {
@@ -72,30 +84,266 @@ func insertCommas(str string, n int) string {
 	return buffer.String()
 }
 
+// linkResolverGroup coalesces concurrent doRequest calls for the same cache
+// key into a single upstream fetch; every caller gets the one result.
+var linkResolverGroup singleflight.Group
+
+// pendingRequest tracks how many callers are still waiting on the shared
+// fetch for a cache key, so the outbound HTTP request can be cancelled as
+// soon as every one of them gives up - independently of singleflight.Group,
+// which only knows how to fan a result out to callers, not how to cancel
+// the work early. reqCtx is what actually gets passed to doRequest; cancel
+// tears it down either when the shared call finishes or when waiters drops
+// to zero, whichever happens first.
+type pendingRequest struct {
+	reqCtx  context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
 var linkResolverRequestsMutex sync.Mutex
-var linkResolverRequests = make(map[string][](chan interface{}))
+var linkResolverRequests = make(map[string]*pendingRequest)
+
+// defaultLinkCacheDuration is how long a resolved link is cached for when
+// the resolver that produced it doesn't have an opinion of its own.
+const defaultLinkCacheDuration = 10 * time.Minute
+
+// resolverRequestTimeout bounds how long doRequest is allowed to spend
+// resolving a single URL, regardless of how long the upstream server takes
+// to respond. It's independent of any one waiter's context so that a slow
+// request started by the first caller keeps running for anyone who joins
+// it afterwards, even once the first caller has given up.
+const resolverRequestTimeout = 15 * time.Second
 
+// resolverTimeoutResponse is what a waiter gets back when its context is
+// done (client disconnect, or resolverRequestTimeout elapsing) before the
+// shared request produced a result.
+var resolverTimeoutResponse = &LinkResolverResponse{
+	Status:  504,
+	Message: "resolver timeout",
+}
+
+// errAbandonedRequest is returned by doRequest's cacheGetOrSet closure when
+// the fetch was cut short by a cancelled context rather than a genuine
+// upstream outcome. cacheGetOrSet still hands the computed (timeout) value
+// back to the caller that asked for it, but - because the error is non-nil -
+// skips writing it through to the shared cache, so an abandoned request for
+// one caller can't poison the result every other viewer of the same URL sees.
+var errAbandonedRequest = errors.New("link resolver: request abandoned")
+
+// maxHTMLBodySize caps how much of an HTML response we'll actually read and
+// feed into goquery. Chat links occasionally point at multi-gigabyte files;
+// there's no reason to pull more than this down just to find a <title>.
+const maxHTMLBodySize = 5 * 1024 * 1024 // 5 MiB
+
+func isHTMLContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	return contentType == "text/html" || contentType == "application/xhtml+xml"
+}
+
+// sizeTypeTooltip renders the "<type> · <size>" fallback tooltip shown for
+// links whose Content-Type isn't HTML (or whose body is too big to bother
+// parsing), regardless of whether that Content-Type came from a trusted
+// HEAD response or the GET response itself.
+func sizeTypeTooltip(contentType string, contentLength int64, url string) []byte {
+	typeName := contentType
+	if typeName == "" {
+		typeName = "unknown type"
+	}
+	tooltip := fmt.Sprintf("<div style=\"text-align: left;\">%s", html.EscapeString(typeName))
+	if contentLength >= 0 {
+		tooltip += fmt.Sprintf(" · %s", humanSize(contentLength))
+	}
+	tooltip += fmt.Sprintf("<hr><b>URL:</b> %s</div>", html.EscapeString(url))
+	body, _ := json.Marshal(&LinkResolverResponse{
+		Status:  200,
+		Tooltip: tooltip,
+		Link:    url,
+	})
+	return body
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// customURLManager resolves a specific kind of link (e.g. a YouTube video,
+// a tweet) into a tooltip, without going through the generic goquery
+// title-scrape path. hostPattern is matched against the request URL's host
+// before run is ever called, so run can assume it's looking at a link it
+// knows how to handle.
 type customURLManager struct {
-	check func(resp *http.Response) bool
-	run   func(resp *http.Response) ([]byte, error)
+	hostPattern *regexp.Regexp
+	run         func(ctx context.Context, u *neturl.URL) ([]byte, time.Duration, error)
 }
 
-var (
-	customURLManagers []customURLManager
-)
+var customURLManagers []customURLManager
+
+// RegisterCustomResolver registers a site-specific resolver for links whose
+// host matches hostPattern (a regular expression, e.g. "(^|\\.)youtube\\.com$").
+// Resolvers are tried in registration order before the generic goquery
+// fallback; run is responsible for doing any network requests it needs
+// (honouring ctx, same as the generic path, so resolverRequestTimeout and
+// client disconnects apply here too) and returns the encoded
+// LinkResolverResponse body, along with how long the result should be
+// cached for (defaultLinkCacheDuration is used if ttl <= 0).
+func RegisterCustomResolver(hostPattern string, run func(ctx context.Context, u *neturl.URL) ([]byte, time.Duration, error)) {
+	customURLManagers = append(customURLManagers, customURLManager{
+		hostPattern: regexp.MustCompile(hostPattern),
+		run:         run,
+	})
+}
+
+// sniffContentType issues a HEAD request for url and reports the Content-Type
+// and Content-Length it got back, without pulling down the body, along with
+// the HEAD response's own status code so callers can tell a trustworthy
+// response (2xx) apart from one that doesn't actually say anything about the
+// resource (a CDN/API returning 403/405 to HEAD while serving the real page
+// fine over GET is common enough that callers must check this). contentLength
+// is -1 when the server didn't send one. Redirects are followed by httpClient
+// like any other request.
+func sniffContentType(ctx context.Context, url string) (contentType string, contentLength int64, statusCode int, err error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return "", -1, 0, err
+	}
+	req.Header.Add("Accept-Language", "en-US, en;q=0.9, *;q=0.5")
+	req.Header.Set("User-Agent", PickUserAgent())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", -1, 0, err
+	}
+	defer resp.Body.Close()
+
+	contentLength = int64(-1)
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			contentLength = n
+		}
+	}
+
+	return resp.Header.Get("Content-Type"), contentLength, resp.StatusCode, nil
+}
+
+func findCustomResolver(u *neturl.URL) *customURLManager {
+	for i, m := range customURLManagers {
+		if m.hostPattern.MatchString(u.Host) {
+			return &customURLManagers[i]
+		}
+	}
+	return nil
+}
+
+// metricHostLabel maps a request's host down to the bounded set of values
+// requestsByHost is allowed to see: hosts with a registered custom resolver,
+// by name, and "other" for everything else. Keying the metric directly on
+// u.Host would mean a brand new permanent time series for every distinct
+// domain anyone has ever linked in chat - an unbounded-cardinality footgun.
+func metricHostLabel(u *neturl.URL) string {
+	if findCustomResolver(u) != nil {
+		return u.Host
+	}
+	return "other"
+}
+
+// articleCacheDuration is how long a readability-extracted article is kept,
+// independently of the rendered tooltip response (defaultLinkCacheDuration).
+// It outlives the tooltip cache so that a rich-format request for a page
+// that was already extracted doesn't run readability on it again; the page
+// itself is still fetched on every tooltip cache miss.
+const articleCacheDuration = 24 * time.Hour
 
-func doRequest(url string) {
-	response := cacheGetOrSet("url:"+url, 10*time.Minute, func() (interface{}, error) {
-		req, err := http.NewRequest("GET", url, nil)
+// requestCacheKey is what both the result cache and linkResolverGroup's
+// in-flight coalescing are keyed on. richFormat gets its own key because
+// it's a different response body for the same URL.
+func requestCacheKey(url string, richFormat bool) string {
+	if richFormat {
+		return "url:" + url + ":rich"
+	}
+	return "url:" + url
+}
+
+// resolveCustomURL runs a custom resolver for u and caches the result under
+// cacheKey using the TTL the resolver itself returns, falling back to
+// defaultLinkCacheDuration when it doesn't have an opinion (ttl <= 0).
+// cacheGetOrSet can't be used here: its ttl argument is evaluated before the
+// closure ever runs, so it has no way to reflect a TTL the closure only
+// learns about once a resolver like YouTube's or Vimeo's has actually run.
+func resolveCustomURL(ctx context.Context, cacheKey string, u *neturl.URL, m *customURLManager) interface{} {
+	if cached := cacheGet(cacheKey); cached != nil {
+		return cached
+	}
+
+	body, ttl, err := m.run(ctx, u)
+	if err != nil {
+		body, _ = json.Marshal(&LinkResolverResponse{Status: 500, Message: "custom resolver error " + err.Error()})
+	}
+	if ttl <= 0 {
+		ttl = defaultLinkCacheDuration
+	}
+	cacheSet(cacheKey, body, ttl)
+	return body
+}
+
+func doRequest(ctx context.Context, url string, richFormat bool) interface{} {
+	cacheKey := requestCacheKey(url, richFormat)
+
+	inFlightRequests.Inc()
+	defer inFlightRequests.Dec()
+
+	parsedURL, parseErr := neturl.Parse(url)
+	if parseErr == nil {
+		requestsByHost.WithLabelValues(metricHostLabel(parsedURL)).Inc()
+		if m := findCustomResolver(parsedURL); m != nil {
+			return resolveCustomURL(ctx, cacheKey, parsedURL, m)
+		}
+	}
+
+	return cacheGetOrSet(cacheKey, defaultLinkCacheDuration, func() (interface{}, error) {
+		contentType, contentLength, headStatus, headErr := sniffContentType(ctx, url)
+		oversized := contentLength > maxHTMLBodySize
+		headReliable := headErr == nil && headStatus >= 200 && headStatus <= 299
+
+		if headReliable && (!isHTMLContentType(contentType) || oversized) {
+			return sizeTypeTooltip(contentType, contentLength, url), nil
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 		if err != nil {
 			return nil, err
 		}
 		// ensures websites return pages in english (e.g. twitter would return french preview
 		// when the request came from a french IP.)
 		req.Header.Add("Accept-Language", "en-US, en;q=0.9, *;q=0.5")
+		req.Header.Add("Range", fmt.Sprintf("bytes=0-%d", maxHTMLBodySize))
+		req.Header.Set("User-Agent", PickUserAgent())
 
+		upstreamStart := time.Now()
 		resp, err := httpClient.Do(req)
+		upstreamLatencySeconds.Observe(time.Since(upstreamStart).Seconds())
 		if err != nil {
+			if ctx.Err() != nil {
+				// The fetch was abandoned (client disconnected, or the
+				// shared request hit resolverRequestTimeout) rather than
+				// genuinely failing against the upstream - don't let this
+				// get written through to the shared cache.
+				body, _ := json.Marshal(resolverTimeoutResponse)
+				return body, errAbandonedRequest
+			}
 			if strings.HasSuffix(err.Error(), "no such host") {
 				return json.Marshal(noLinkInfoFound)
 			}
@@ -104,48 +352,82 @@ func doRequest(url string) {
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-			doc, err := goquery.NewDocumentFromReader(resp.Body)
+		// resp.StatusCode is 206 when the server honoured our Range request,
+		// or a regular 2xx when it ignored it and sent the whole body.
+		if (resp.StatusCode >= 200 && resp.StatusCode <= 299) || resp.StatusCode == 206 {
+			// The HEAD response wasn't trustworthy enough to gate on (that's
+			// exactly how we got here instead of stopping above), so the GET
+			// response is the first real look we get at this resource's
+			// Content-Type - check it too before assuming it's HTML.
+			if getContentType := resp.Header.Get("Content-Type"); !isHTMLContentType(getContentType) {
+				getContentLength := int64(-1)
+				if cl := resp.Header.Get("Content-Length"); cl != "" {
+					if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+						getContentLength = n
+					}
+				}
+				return sizeTypeTooltip(getContentType, getContentLength, resp.Request.URL.String()), nil
+			}
+
+			bodyBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxHTMLBodySize))
+			if err != nil {
+				return json.Marshal(&LinkResolverResponse{Status: 500, Message: "error reading body " + err.Error()})
+			}
+			finalURL := resp.Request.URL.String()
+
+			doc, err := goquery.NewDocumentFromReader(bytes.NewReader(bodyBytes))
 			if err != nil {
 				return json.Marshal(&LinkResolverResponse{Status: 500, Message: "html parser error " + err.Error()})
 			}
 
-			for _, m := range customURLManagers {
-				if m.check(resp) {
-					return m.run(resp)
+			plainTitle := doc.Find("title").First().Text()
+
+			if !richFormat {
+				escapedTitle := ""
+				if plainTitle != "" {
+					escapedTitle = fmt.Sprintf("<b>%s</b><hr>", html.EscapeString(plainTitle))
 				}
+				return json.Marshal(&LinkResolverResponse{
+					Status:  resp.StatusCode,
+					Tooltip: fmt.Sprintf("<div style=\"text-align: left;\">%s<b>URL:</b> %s</div>", escapedTitle, html.EscapeString(finalURL)),
+					Link:    finalURL,
+				})
 			}
 
-			escapedTitle := doc.Find("title").First().Text()
-			if escapedTitle != "" {
-				escapedTitle = fmt.Sprintf("<b>%s</b><hr>", html.EscapeString(escapedTitle))
+			articleData := cacheGetOrSet("article:"+finalURL, articleCacheDuration, func() (interface{}, error) {
+				art, err := extractArticle(finalURL, bodyBytes)
+				if err != nil {
+					return nil, err
+				}
+				return json.Marshal(art)
+			})
+
+			var art article
+			if articleBytes, ok := articleData.([]byte); ok {
+				_ = json.Unmarshal(articleBytes, &art)
+			}
+			if art.Title == "" {
+				art.Title = plainTitle
 			}
+
 			return json.Marshal(&LinkResolverResponse{
-				Status:  resp.StatusCode,
-				Tooltip: fmt.Sprintf("<div style=\"text-align: left;\">%s<b>URL:</b> %s</div>", escapedTitle, html.EscapeString(resp.Request.URL.String())),
-				Link:    resp.Request.URL.String(),
+				Status:    resp.StatusCode,
+				Tooltip:   buildArticleTooltip(finalURL, &art),
+				Link:      finalURL,
+				SiteName:  art.SiteName,
+				Thumbnail: art.Image,
 			})
 		}
 
 		return json.Marshal(noLinkInfoFound)
 	})
+}
 
-	linkResolverRequestsMutex.Lock()
-	fmt.Println("Notify channels")
-	for _, channel := range linkResolverRequests[url] {
-		fmt.Printf("Notify channel %v\n", channel)
-		/*
-			select {
-			case channel <- response:
-				fmt.Println("hehe")
-			default:
-				fmt.Println("Unable to respond")
-			}
-		*/
-		channel <- response
-	}
-	delete(linkResolverRequests, url)
-	linkResolverRequestsMutex.Unlock()
+// RegisterRoutes wires up every HTTP route this package serves onto r:
+// the link resolver itself, plus /metrics for Prometheus to scrape.
+func RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/link_resolver/{url}", linkResolver)
+	r.HandleFunc("/metrics", metricsHandler)
 }
 
 func linkResolver(w http.ResponseWriter, r *http.Request) {
@@ -163,27 +445,71 @@ func linkResolver(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cacheKey := "url:" + url
+	// Chatterino clients opt into the readability-based rich tooltip by
+	// passing ?richFormat=true; anyone who doesn't gets the plain
+	// title-scrape response, unchanged.
+	richFormat := r.URL.Query().Get("richFormat") == "true"
+	cacheKey := requestCacheKey(url, richFormat)
+
+	ctx := r.Context()
 
 	var response interface{}
 
 	if data := cacheGet(cacheKey); data != nil {
+		cacheHitsTotal.Inc()
 		response = data
 	} else {
-		responseChannel := make(chan interface{})
+		cacheMissesTotal.Inc()
 
+		// pending's reqCtx is independent of our own request context, so the
+		// shared fetch keeps running for any other waiter that joins
+		// afterwards, even once we give up - bounded by resolverRequestTimeout
+		// regardless, but torn down early the moment the last waiter for this
+		// key disconnects, so an abandoned fetch doesn't run for the full
+		// timeout with nobody left to hand the result to.
 		linkResolverRequestsMutex.Lock()
-		linkResolverRequests[url] = append(linkResolverRequests[url], responseChannel)
-		urlRequestsLength := len(linkResolverRequests[url])
-		linkResolverRequestsMutex.Unlock()
-		if urlRequestsLength == 1 {
-			// First poll for this URL, start the request!
-			go doRequest(url)
+		pending, ok := linkResolverRequests[cacheKey]
+		if !ok {
+			reqCtx, cancel := context.WithTimeout(context.Background(), resolverRequestTimeout)
+			pending = &pendingRequest{reqCtx: reqCtx, cancel: cancel}
+			linkResolverRequests[cacheKey] = pending
 		}
+		pending.waiters++
+		linkResolverRequestsMutex.Unlock()
+
+		// DoChan only ever invokes the closure for the first caller of a
+		// given key; everyone else just waits on the shared result.
+		startedHere := false
+		resultChan := linkResolverGroup.DoChan(cacheKey, func() (interface{}, error) {
+			startedHere = true
+			defer func() {
+				linkResolverRequestsMutex.Lock()
+				delete(linkResolverRequests, cacheKey)
+				linkResolverRequestsMutex.Unlock()
+				pending.cancel()
+			}()
+			return doRequest(pending.reqCtx, url, richFormat), nil
+		})
 
-		fmt.Printf("Listening to channel %v\n", responseChannel)
-		response = <-responseChannel
-		fmt.Println("got response!")
+		select {
+		case result := <-resultChan:
+			if !startedHere {
+				coalescedRequestsTotal.Inc()
+			}
+			response = result.Val
+		case <-ctx.Done():
+			linkResolverRequestsMutex.Lock()
+			if pending.waiters--; pending.waiters == 0 {
+				pending.cancel()
+			}
+			linkResolverRequestsMutex.Unlock()
+
+			response, err = json.Marshal(resolverTimeoutResponse)
+			if err != nil {
+				fmt.Println("Error marshalling resolverTimeoutResponse:", err)
+				return
+			}
+		}
 	}
 
 	_, err = w.Write(response.([]byte))
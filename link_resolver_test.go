@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// withTestHTTPClient points the package-level httpClient at server for the
+// duration of the test, restoring it afterwards so tests don't leak state
+// into each other.
+func withTestHTTPClient(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	prev := httpClient
+	httpClient = server.Client()
+	t.Cleanup(func() { httpClient = prev })
+}
+
+// TestDoRequest_HEADStatusGating covers the regression where a site
+// returning a non-2xx status to HEAD (common on CDNs/APIs that don't
+// support the method) had its unreliable Content-Type/Content-Length
+// trusted anyway, permanently hiding a real HTML page's title behind an
+// "unknown type" tooltip instead of falling through to GET.
+func TestDoRequest_HEADStatusGating(t *testing.T) {
+	const page = `<html><head><title>Example Page</title></head><body></body></html>`
+
+	tests := []struct {
+		name       string
+		headStatus int
+		// wantTitle is false where HEAD succeeds: its non-HTML Content-Type
+		// is then trusted, so the size/type tooltip is expected instead.
+		wantTitle bool
+	}{
+		{"head succeeds", http.StatusOK, false},
+		{"head forbidden", http.StatusForbidden, true},
+		{"head method not allowed", http.StatusMethodNotAllowed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					w.Header().Set("Content-Type", "application/octet-stream")
+					w.WriteHeader(tt.headStatus)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(page))
+			}))
+			defer server.Close()
+			withTestHTTPClient(t, server)
+
+			result := doRequest(context.Background(), server.URL, false)
+			body, ok := result.([]byte)
+			if !ok {
+				t.Fatalf("doRequest returned %T, want []byte", result)
+			}
+			if tt.wantTitle && !strings.Contains(string(body), "Example Page") {
+				t.Errorf("response %s does not contain the scraped title", body)
+			}
+			if !tt.wantTitle && !strings.Contains(string(body), "application/octet-stream") {
+				t.Errorf("response %s is not the size/type tooltip from the trusted HEAD", body)
+			}
+		})
+	}
+}
+
+// TestDoRequest_UnreliableHEADFallsThroughToGETTypeCheck covers the case
+// where HEAD returns a non-2xx (so its Content-Type can't be trusted) but
+// the real GET response turns out not to be HTML at all - the GET response's
+// own Content-Type must still gate goquery parsing, producing a size/type
+// tooltip instead of silently treating a PNG (or any other binary) as HTML
+// with an empty title.
+func TestDoRequest_UnreliableHEADFallsThroughToGETTypeCheck(t *testing.T) {
+	const pngBody = "not actually a png, just needs a length"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(pngBody))
+	}))
+	defer server.Close()
+	withTestHTTPClient(t, server)
+
+	result := doRequest(context.Background(), server.URL, false)
+	body, ok := result.([]byte)
+	if !ok {
+		t.Fatalf("doRequest returned %T, want []byte", result)
+	}
+	if !strings.Contains(string(body), "image/png") {
+		t.Errorf("expected a size/type tooltip mentioning image/png, got %s", body)
+	}
+}
+
+// newResolverRequest builds a request for linkResolver as if mux had routed
+// it, the way unescapeURLArgument expects (mux.Vars()["url"], URL-escaped).
+func newResolverRequest(targetURL string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/link_resolver/x", nil)
+	return mux.SetURLVars(req, map[string]string{"url": neturl.PathEscape(targetURL)})
+}
+
+// TestDoRequest_ContentTypeSniffing exercises the oversized and
+// missing-Content-Length paths of the HEAD-based gating, plus a server that
+// ignores our Range header and just sends the whole body anyway.
+func TestDoRequest_ContentTypeSniffing(t *testing.T) {
+	t.Run("oversized falls back to size tooltip", func(t *testing.T) {
+		big := make([]byte, maxHTMLBodySize+1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Length", strconv.Itoa(len(big)))
+			if r.Method == http.MethodHead {
+				return
+			}
+			w.Write(big)
+		}))
+		defer server.Close()
+		withTestHTTPClient(t, server)
+
+		result := doRequest(context.Background(), server.URL, false)
+		body, _ := result.([]byte)
+		if !strings.Contains(string(body), "URL:") {
+			t.Fatalf("expected a size-tooltip fallback response, got %s", body)
+		}
+		if strings.Contains(string(body), "<title>") {
+			t.Errorf("oversized body should not have been parsed for a title: %s", body)
+		}
+	})
+
+	t.Run("missing content-length still scrapes title", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			if r.Method == http.MethodHead {
+				return
+			}
+			w.Write([]byte(`<html><head><title>No Length Header</title></head></html>`))
+		}))
+		defer server.Close()
+		withTestHTTPClient(t, server)
+
+		result := doRequest(context.Background(), server.URL, false)
+		body, _ := result.([]byte)
+		if !strings.Contains(string(body), "No Length Header") {
+			t.Errorf("response %s does not contain the scraped title", body)
+		}
+	})
+
+	t.Run("server ignores range header", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			if r.Method == http.MethodHead {
+				return
+			}
+			// A plain 200 with the full body, as if the server never looked
+			// at our Range header - doRequest already handles this by
+			// accepting both 206 and a regular 2xx.
+			w.Write([]byte(`<html><head><title>Ignored My Range</title></head></html>`))
+		}))
+		defer server.Close()
+		withTestHTTPClient(t, server)
+
+		result := doRequest(context.Background(), server.URL, false)
+		body, _ := result.([]byte)
+		if !strings.Contains(string(body), "Ignored My Range") {
+			t.Errorf("response %s does not contain the scraped title", body)
+		}
+	})
+}
+
+// TestLinkResolver_ConcurrentRequestsCoalesce proves that N simultaneous
+// requests for the same URL produce exactly one upstream GET, via
+// linkResolverGroup, instead of each caller triggering its own fetch.
+func TestLinkResolver_ConcurrentRequestsCoalesce(t *testing.T) {
+	const n = 20
+
+	var gets int64
+	var started sync.WaitGroup
+	started.Add(n)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.Method == http.MethodHead {
+			return
+		}
+		atomic.AddInt64(&gets, 1)
+		<-release
+		w.Write([]byte(`<html><head><title>Coalesced</title></head></html>`))
+	}))
+	defer server.Close()
+	withTestHTTPClient(t, server)
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			started.Done()
+			started.Wait()
+			w := httptest.NewRecorder()
+			linkResolver(w, newResolverRequest(server.URL))
+		}()
+	}
+
+	started.Wait()
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt64(&gets); got != 1 {
+		t.Errorf("got %d upstream GETs for %d concurrent callers, want 1", got, n)
+	}
+}
+
+// TestLinkResolver_ClientCancelDoesNotPoisonCache reproduces the bug where a
+// single client disconnecting early turned an abandoned, never-actually-
+// checked fetch into a cached "resolver timeout" for every other viewer of
+// the same URL. Cancelling the request should still get the disconnecting
+// caller a timeout response, but must not write anything through to the
+// shared cache.
+func TestLinkResolver_ClientCancelDoesNotPoisonCache(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>Slow Page</title></head></html>`))
+	}))
+	defer server.Close()
+	withTestHTTPClient(t, server)
+
+	cacheKey := requestCacheKey(server.URL, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := newResolverRequest(server.URL).WithContext(ctx)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		linkResolver(w, req)
+	}()
+
+	cancel()
+	<-done
+
+	if !strings.Contains(w.Body.String(), "resolver timeout") {
+		t.Errorf("expected a resolver timeout response for the cancelled caller, got %s", w.Body.String())
+	}
+	if cached := cacheGet(cacheKey); cached != nil {
+		t.Errorf("cancelled fetch poisoned the cache: cacheGet(%q) = %s, want nil", cacheKey, cached)
+	}
+}
+
+// TestLinkResolver_LastWaiterCancelAbortsUpstream proves that when every
+// caller waiting on a shared fetch disconnects, the outbound HTTP request is
+// actually cancelled rather than being left to run for the full
+// resolverRequestTimeout with nobody left to hand the result to.
+func TestLinkResolver_LastWaiterCancelAbortsUpstream(t *testing.T) {
+	aborted := make(chan struct{})
+	arrived := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer server.Close()
+	withTestHTTPClient(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := newResolverRequest(server.URL).WithContext(ctx)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		linkResolver(w, req)
+	}()
+
+	// Only disconnect once the outbound request is actually in flight.
+	<-arrived
+	cancel()
+	<-done
+
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("outbound request was not aborted after the last waiter disconnected")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	cacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chatterino_api_cache_hits_total",
+		Help: "Link resolutions served straight from cache, without touching doRequest.",
+	})
+
+	cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chatterino_api_cache_misses_total",
+		Help: "Link resolutions that required a doRequest call.",
+	})
+
+	coalescedRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chatterino_api_coalesced_requests_total",
+		Help: "Requests that joined an already in-flight doRequest for the same cache key instead of starting their own.",
+	})
+
+	inFlightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chatterino_api_in_flight_requests",
+		Help: "doRequest calls currently resolving a link.",
+	})
+
+	requestsByHost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatterino_api_requests_by_host_total",
+		Help: "Link resolutions attempted, by target host (hosts without a registered custom resolver are bucketed as \"other\" to bound cardinality).",
+	}, []string{"host"})
+
+	upstreamLatencySeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chatterino_api_upstream_latency_seconds",
+		Help:    "Time spent waiting on the upstream GET request in doRequest.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// metricsHandler serves Prometheus-format metrics. It's a plain function
+// value, same as linkResolver, so RegisterRoutes wires it up the same way:
+// another mux route registration alongside linkResolver's.
+var metricsHandler = promhttp.Handler().ServeHTTP
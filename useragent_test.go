@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPickWeighted_AlwaysPicksNonZeroShare proves a version with zero usage
+// share never wins the weighted pick as long as another entry has weight.
+func TestPickWeighted_AlwaysPicksNonZeroShare(t *testing.T) {
+	pool := []uaVersion{
+		{Browser: "chrome", Version: "1.0", Global: 0},
+		{Browser: "chrome", Version: "2.0", Global: 100},
+	}
+	for i := 0; i < 50; i++ {
+		if got := pickWeighted(pool); got.Version != "2.0" {
+			t.Fatalf("pickWeighted picked %q, want the only version with nonzero share", got.Version)
+		}
+	}
+}
+
+// TestPickWeighted_ZeroTotalFallsBackToFirst covers the degenerate case
+// where every candidate has a zero (or negative) share, which would
+// otherwise make the weighted loop never select anything.
+func TestPickWeighted_ZeroTotalFallsBackToFirst(t *testing.T) {
+	pool := []uaVersion{
+		{Browser: "chrome", Version: "1.0", Global: 0},
+		{Browser: "chrome", Version: "2.0", Global: 0},
+	}
+	if got := pickWeighted(pool); got.Version != "1.0" {
+		t.Errorf("pickWeighted with zero total = %q, want pool[0]", got.Version)
+	}
+}
+
+// TestFormatUserAgent_Variants spot-checks the desktop/mobile strings for
+// both supported browsers and Chrome's bot string, since PickUserAgent's output ends up as a
+// real outbound User-Agent header and typos there are easy to miss.
+func TestFormatUserAgent_Variants(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       uaVersion
+		variant string
+		want    string
+	}{
+		{"chrome desktop", uaVersion{Browser: "chrome", Version: "124.0.0.0"}, "desktop", "Chrome/124.0.0.0 Safari"},
+		{"chrome mobile", uaVersion{Browser: "chrome", Version: "124.0.0.0"}, "mobile", "Android 14"},
+		{"chrome bot", uaVersion{Browser: "chrome", Version: "124.0.0.0"}, "bot", "Chatterino-API-Cache"},
+		{"firefox desktop", uaVersion{Browser: "firefox", Version: "124.0"}, "desktop", "Firefox/124.0"},
+		{"firefox mobile", uaVersion{Browser: "firefox", Version: "124.0"}, "mobile", "Mobile; rv:124.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua := formatUserAgent(tt.v, tt.variant)
+			if !strings.Contains(ua, tt.want) {
+				t.Errorf("formatUserAgent(%+v, %q) = %q, want it to contain %q", tt.v, tt.variant, ua, tt.want)
+			}
+		})
+	}
+}
+
+// TestSetUserAgentPool_OverridesPick proves the test-only override hook
+// actually takes effect and that clearing it (pool = nil) falls back to
+// whatever currentUserAgentPool would otherwise return.
+func TestSetUserAgentPool_OverridesPick(t *testing.T) {
+	defer SetUserAgentPool(nil)
+
+	SetUserAgentPool([]uaVersion{{Browser: "firefox", Version: "999.0", Global: 1}})
+	if got := PickUserAgent(); !strings.Contains(got, "999.0") {
+		t.Errorf("PickUserAgent() = %q, want it to reflect the overridden pool", got)
+	}
+
+	SetUserAgentPool(nil)
+	if got := PickUserAgent(); strings.Contains(got, "999.0") {
+		t.Errorf("PickUserAgent() = %q, override should have been cleared", got)
+	}
+}
+
+// TestRefreshUserAgentPool_ParsesCaniuseData feeds refreshUserAgentPool a
+// fake caniuse dataset and checks it keeps only the top uaTopN versions per
+// browser by usage share.
+func TestRefreshUserAgentPool_ParsesCaniuseData(t *testing.T) {
+	const body = `{
+		"agents": {
+			"chrome": {"usage_global": {"124": 10, "123": 20, "122": 5, "121": 1, "120": 0.5, "119": 0.1}},
+			"firefox": {"usage_global": {"124": 3, "123": 2}}
+		}
+	}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	withTestHTTPClient(t, server)
+
+	defer SetUserAgentPool(nil)
+	prevURL := caniuseDataURL
+	caniuseDataURL = server.URL
+	defer func() { caniuseDataURL = prevURL }()
+
+	if err := refreshUserAgentPool(); err != nil {
+		t.Fatalf("refreshUserAgentPool() = %v, want nil", err)
+	}
+
+	pool := currentUserAgentPool()
+	var chromeCount, firefoxCount int
+	for _, v := range pool {
+		switch v.Browser {
+		case "chrome":
+			chromeCount++
+		case "firefox":
+			firefoxCount++
+		}
+	}
+	if chromeCount != uaTopN {
+		t.Errorf("got %d chrome versions, want the top %d by usage share", chromeCount, uaTopN)
+	}
+	if firefoxCount != 2 {
+		t.Errorf("got %d firefox versions, want all 2 available", firefoxCount)
+	}
+}
+
+// TestRefreshUserAgentPool_BadStatusLeavesPoolAlone proves a failed refresh
+// doesn't clobber the existing (built-in or previously-refreshed) pool.
+func TestRefreshUserAgentPool_BadStatusLeavesPoolAlone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	withTestHTTPClient(t, server)
+
+	prevURL := caniuseDataURL
+	caniuseDataURL = server.URL
+	defer func() { caniuseDataURL = prevURL }()
+
+	before := currentUserAgentPool()
+	if err := refreshUserAgentPool(); err == nil {
+		t.Fatal("refreshUserAgentPool() = nil error, want an error for a 500 response")
+	}
+	after := currentUserAgentPool()
+	if len(before) != len(after) {
+		t.Errorf("pool changed after a failed refresh: before=%d after=%d", len(before), len(after))
+	}
+}